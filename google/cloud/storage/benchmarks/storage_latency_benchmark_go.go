@@ -15,64 +15,403 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"math/rand"
+	"net/http"
 	"os"
+	"path"
 	"runtime"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/storage"
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 )
 
 const (
 	kDefaultDurationSeconds = 60
 	kDefaultObjectCount     = 10000
+
+	// Histogram buckets span from 1ms to 60s, with ~15 buckets per decade.
+	// That is enough resolution to tell p50 from p99.9 apart without
+	// spending more than a few KiB per op-type, no matter how long the
+	// test runs.
+	kHistogramMinMs            = 1.0
+	kHistogramMaxMs            = 60000.0
+	kHistogramBucketsPerDecade = 15
+
+	// kPromPushInterval is how often the prom sink pushes a snapshot to the
+	// Pushgateway while RunTest is running, so an endurance run is actually
+	// visible on a dashboard while it is in progress, not just after the
+	// bucket has already been torn down.
+	kPromPushInterval = 15 * time.Second
 )
 
+var suppressRaw = flag.Bool("no-raw", false,
+	"suppress the raw per-iteration CSV output; the jsonl and prom sinks still receive every record")
+var transport = flag.String("transport", envOrDefault("STORAGE_TRANSPORT", "http"),
+	"storage transport to use: http or grpc (env: STORAGE_TRANSPORT)")
+var endpoint = flag.String("endpoint", os.Getenv("STORAGE_ENDPOINT"),
+	"optional API endpoint override, e.g. for an emulator or a private endpoint (env: STORAGE_ENDPOINT)")
+var pushgatewayURL = flag.String("pushgateway", "",
+	"Prometheus Pushgateway URL to push per-op counters and latency histogram buckets to")
+
+func envOrDefault(name string, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// stringSliceFlag implements flag.Value to collect a repeatable flag into a
+// slice, e.g. --output=csv --output=jsonl.
+type stringSliceFlag []string
+
+func (s *stringSliceFlag) String() string { return strings.Join(*s, ",") }
+
+func (s *stringSliceFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+var outputModes stringSliceFlag
+
+func init() {
+	flag.Var(&outputModes, "output", "result sink(s) to enable: csv, jsonl, or prom (repeatable, default csv)")
+}
+
+// gBucketName and gLocation are set once in main and read by sinks that
+// annotate every record with which run produced it.
+var gBucketName string
+var gLocation string
+
+// resultSeq is a monotonically increasing sequence number shared by every
+// sink, so records from different threads can be ordered back together.
+var resultSeq int64
+
 type IterationResult struct {
-	op      string
-	success bool
-	elapsed time.Duration
+	op        string
+	success   bool
+	elapsed   time.Duration
+	transport string
 }
 
 type TestResult []IterationResult
 
+// Histogram is a small, fixed-memory latency histogram with logarithmically
+// spaced buckets. It is meant to be owned by a single goroutine while
+// samples are being recorded (so Record needs no locking) and combined with
+// Merge once the goroutine is done.
+type Histogram struct {
+	bounds []float64 // upper bound, in milliseconds, of each bucket but the last
+	counts []int64
+	count  int64
+	sum    float64
+	min    float64
+	max    float64
+}
+
+func NewHistogram() *Histogram {
+	var bounds []float64
+	ratio := math.Pow(10, 1.0/kHistogramBucketsPerDecade)
+	for b := kHistogramMinMs; b < kHistogramMaxMs; b *= ratio {
+		bounds = append(bounds, b)
+	}
+	return &Histogram{bounds: bounds, counts: make([]int64, len(bounds)+1), min: math.MaxFloat64}
+}
+
+func (h *Histogram) Record(elapsed time.Duration) {
+	ms := float64(elapsed) / float64(time.Millisecond)
+	h.counts[sort.SearchFloat64s(h.bounds, ms)]++
+	h.count++
+	h.sum += ms
+	if ms < h.min {
+		h.min = ms
+	}
+	if ms > h.max {
+		h.max = ms
+	}
+}
+
+func (h *Histogram) Merge(other *Histogram) {
+	for i := range h.counts {
+		h.counts[i] += other.counts[i]
+	}
+	h.count += other.count
+	h.sum += other.sum
+	if other.min < h.min {
+		h.min = other.min
+	}
+	if other.max > h.max {
+		h.max = other.max
+	}
+}
+
+// Percentile returns the upper bound, in milliseconds, of the bucket
+// containing the p-th percentile (0 < p <= 100).
+func (h *Histogram) Percentile(p float64) float64 {
+	if h.count == 0 {
+		return 0
+	}
+	target := int64(math.Ceil(p / 100.0 * float64(h.count)))
+	var running int64
+	for i, c := range h.counts {
+		running += c
+		if running >= target {
+			if i < len(h.bounds) {
+				return h.bounds[i]
+			}
+			return h.max
+		}
+	}
+	return h.max
+}
+
+func (h *Histogram) Mean() float64 {
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / float64(h.count)
+}
+
+func PrintHistogramSummary(op string, h *Histogram) {
+	if h.count == 0 {
+		return
+	}
+	fmt.Printf("# %-6s latency(ms): count=%-8d min=%-10.1f mean=%-10.1f p50=%-10.1f"+
+		" p90=%-10.1f p99=%-10.1f p99.9=%-10.1f max=%-10.1f\n",
+		op, h.count, h.min, h.Mean(), h.Percentile(50), h.Percentile(90),
+		h.Percentile(99), h.Percentile(99.9), h.max)
+}
+
+// ResultSink receives every IterationResult as the benchmark runs and does
+// something durable with it. Record is called once per iteration; Flush is
+// called at shutdown, after the bucket under test has been torn down, so
+// sinks that batch or push to a remote system get a chance to drain. A
+// PromSink's Flush is also called every kPromPushInterval while RunTest runs,
+// see startPeriodicPromPush.
+type ResultSink interface {
+	Record(seq int64, threadID int, r IterationResult)
+	Flush()
+}
+
+// CSVSink prints the benchmark's plain "op,success,elapsed_ms,transport" CSV
+// stream, kept as the default sink for scripts that already parse it.
+type CSVSink struct{}
+
+func (CSVSink) Record(seq int64, threadID int, r IterationResult) {
+	fmt.Printf("%s,%t,%d,%s\n", r.op, r.success, r.elapsed.Nanoseconds()/1000000, r.transport)
+}
+
+func (CSVSink) Flush() {}
+
+// jsonlRecord is the schema written, one per line, by JSONLSink.
+type jsonlRecord struct {
+	Seq       int64  `json:"seq"`
+	Bucket    string `json:"bucket"`
+	Location  string `json:"location"`
+	ThreadID  int    `json:"thread_id"`
+	Transport string `json:"transport"`
+	Op        string `json:"op"`
+	Success   bool   `json:"success"`
+	ElapsedNs int64  `json:"elapsed_ns"`
+}
+
+// JSONLSink writes one self-describing JSON object per iteration, so results
+// can be loaded into a dataframe or a log pipeline without a CSV schema
+// living out-of-band.
+type JSONLSink struct{}
+
+func (JSONLSink) Record(seq int64, threadID int, r IterationResult) {
+	b, err := json.Marshal(jsonlRecord{
+		Seq:       seq,
+		Bucket:    gBucketName,
+		Location:  gLocation,
+		ThreadID:  threadID,
+		Transport: r.transport,
+		Op:        r.op,
+		Success:   r.success,
+		ElapsedNs: r.elapsed.Nanoseconds(),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "# Error marshaling jsonl record: %v\n", err)
+		return
+	}
+	fmt.Println(string(b))
+}
+
+func (JSONLSink) Flush() {}
+
+// PromSink accumulates an op-counter and a latency Histogram per op-type and
+// pushes both, in Prometheus text exposition format, to a Pushgateway URL on
+// Flush. This is meant for long endurance runs, where graphing live matters
+// more than a post-hoc CSV/JSONL file.
+type PromSink struct {
+	url string
+
+	mu     sync.Mutex
+	counts map[string]int64
+	hist   map[string]*Histogram
+}
+
+func NewPromSink(url string) *PromSink {
+	return &PromSink{url: url, counts: make(map[string]int64), hist: make(map[string]*Histogram)}
+}
+
+func (p *PromSink) Record(seq int64, threadID int, r IterationResult) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.counts[r.op]++
+	h, ok := p.hist[r.op]
+	if !ok {
+		h = NewHistogram()
+		p.hist[r.op] = h
+	}
+	h.Record(r.elapsed)
+}
+
+func (p *PromSink) Flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# TYPE gcs_benchmark_op_total counter\n")
+	for op, c := range p.counts {
+		fmt.Fprintf(&buf, "gcs_benchmark_op_total{op=%q,transport=%q} %d\n", op, *transport, c)
+	}
+	fmt.Fprintf(&buf, "# TYPE gcs_benchmark_latency_ms_bucket histogram\n")
+	for op, h := range p.hist {
+		var cumulative int64
+		for i, bound := range h.bounds {
+			cumulative += h.counts[i]
+			fmt.Fprintf(&buf, "gcs_benchmark_latency_ms_bucket{op=%q,transport=%q,le=%q} %d\n",
+				op, *transport, strconv.FormatFloat(bound, 'f', -1, 64), cumulative)
+		}
+		cumulative += h.counts[len(h.counts)-1]
+		fmt.Fprintf(&buf, "gcs_benchmark_latency_ms_bucket{op=%q,transport=%q,le=\"+Inf\"} %d\n", op, *transport, cumulative)
+		fmt.Fprintf(&buf, "gcs_benchmark_latency_ms_sum{op=%q,transport=%q} %f\n", op, *transport, h.sum)
+		fmt.Fprintf(&buf, "gcs_benchmark_latency_ms_count{op=%q,transport=%q} %d\n", op, *transport, h.count)
+	}
+
+	jobURL := fmt.Sprintf("%s/metrics/job/gcs_go_latency_benchmark/instance/%s",
+		strings.TrimRight(p.url, "/"), gBucketName)
+	resp, err := http.Post(jobURL, "text/plain; version=0.0.4", &buf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "# Error pushing to pushgateway: %v\n", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// startPeriodicPromPush pushes every PromSink's current snapshot to its
+// Pushgateway on kPromPushInterval until done is closed, so the gateway sees
+// a live series while RunTest runs instead of only a single post-hoc push.
+func startPeriodicPromPush(done <-chan struct{}) {
+	var promSinks []*PromSink
+	for _, s := range sinks {
+		if ps, ok := s.(*PromSink); ok {
+			promSinks = append(promSinks, ps)
+		}
+	}
+	if len(promSinks) == 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(kPromPushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for _, ps := range promSinks {
+					ps.Flush()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// sinks holds the active ResultSinks, built from --output and --pushgateway
+// once flags have been parsed.
+var sinks []ResultSink
+
+func buildSinks() []ResultSink {
+	modes := []string(outputModes)
+	if len(modes) == 0 {
+		modes = []string{"csv"}
+	}
+	var result []ResultSink
+	sawProm := false
+	for _, m := range modes {
+		switch m {
+		case "csv":
+			result = append(result, CSVSink{})
+		case "jsonl":
+			result = append(result, JSONLSink{})
+		case "prom":
+			if *pushgatewayURL == "" {
+				log.Fatal("--output=prom requires --pushgateway")
+			}
+			result = append(result, NewPromSink(*pushgatewayURL))
+			sawProm = true
+		default:
+			log.Fatalf("unknown --output value %q, want csv, jsonl, or prom", m)
+		}
+	}
+	if *pushgatewayURL != "" && !sawProm {
+		result = append(result, NewPromSink(*pushgatewayURL))
+	}
+	return result
+}
+
 func main() {
+	flag.Parse()
+	sinks = buildSinks()
+
 	duration := kDefaultDurationSeconds
 	objectCount := kDefaultObjectCount
 	threadCount := runtime.NumCPU()
 
-	if len(os.Args) < 2 {
-		fmt.Fprintf(os.Stderr, "Usage: endurance_test_go <location>"+
+	if flag.NArg() < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <location>"+
 			" [duration-in-seconds (%d)] [object-count (%d)] [thread-count (%d)]\n",
-			duration, objectCount, threadCount)
+			path.Base(os.Args[0]), duration, objectCount, threadCount)
+		flag.PrintDefaults()
 		os.Exit(1)
 	}
-	location := os.Args[1]
+	location := flag.Arg(0)
 
-	if len(os.Args) > 2 {
-		v, err := strconv.Atoi(os.Args[2])
+	if flag.NArg() > 1 {
+		v, err := strconv.Atoi(flag.Arg(1))
 		if err != nil {
-			log.Fatal("%v while parsing duration argument (%s)", err, os.Args[2])
+			log.Fatal("%v while parsing duration argument (%s)", err, flag.Arg(1))
 		}
 		duration = v
 	}
-	if len(os.Args) > 3 {
-		v, err := strconv.Atoi(os.Args[3])
+	if flag.NArg() > 2 {
+		v, err := strconv.Atoi(flag.Arg(2))
 		if err != nil {
-			log.Fatal("%v while parsing object-count argument (%s)", err, os.Args[3])
+			log.Fatal("%v while parsing object-count argument (%s)", err, flag.Arg(2))
 		}
 		objectCount = v
 	}
-	if len(os.Args) > 4 {
-		v, err := strconv.Atoi(os.Args[4])
+	if flag.NArg() > 3 {
+		v, err := strconv.Atoi(flag.Arg(3))
 		if err != nil {
-			log.Fatal("%v while parsing thread-count argument (%s)", err, os.Args[4])
+			log.Fatal("%v while parsing thread-count argument (%s)", err, flag.Arg(3))
 		}
 		threadCount = v
 	}
@@ -85,7 +424,20 @@ func main() {
 		os.Exit(1)
 	}
 
-	client, err := storage.NewClient(ctx)
+	var clientOpts []option.ClientOption
+	if *endpoint != "" {
+		clientOpts = append(clientOpts, option.WithEndpoint(*endpoint))
+	}
+	var client *storage.Client
+	var err error
+	switch *transport {
+	case "grpc":
+		client, err = storage.NewGRPCClient(ctx, clientOpts...)
+	case "http":
+		client, err = storage.NewClient(ctx, clientOpts...)
+	default:
+		log.Fatalf("unknown --transport value %q, want http or grpc", *transport)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -95,6 +447,8 @@ func main() {
 	rand.Seed(time.Now().UnixNano())
 
 	bucketName := MakeRandomBucketName()
+	gBucketName = bucketName
+	gLocation = location
 	bucket := client.Bucket(bucketName)
 	if err := bucket.Create(ctx, projectID, &storage.BucketAttrs{
 		StorageClass:               "STANDARD",
@@ -109,25 +463,45 @@ func main() {
 	fmt.Printf("# Location: %s\n", location)
 	fmt.Printf("# Object Count: %d\n", objectCount)
 	fmt.Printf("# Thread Count: %d\n", threadCount)
+	fmt.Printf("# Transport: %s\n", *transport)
 	fmt.Printf("# Build info: %s\n", runtime.Version())
 
-	objectNames := CreateAllObjects(bucket, ctx, objectCount)
+	createHistogram := NewHistogram()
+	objectNames := CreateAllObjects(bucket, ctx, objectCount, createHistogram)
 
-	ch := make(chan TestResult, threadCount)
+	ch := make(chan threadResult, threadCount)
+	histograms := make(chan map[string]*Histogram, threadCount)
+	promDone := make(chan struct{})
+	startPeriodicPromPush(promDone)
 	for i := 0; i < threadCount; i++ {
-		go RunTest(bucket, ctx, objectNames, duration, ch)
+		go RunTest(bucket, ctx, objectNames, duration, i+1, ch, histograms)
 	}
+	readHistogram := NewHistogram()
+	writeHistogram := NewHistogram()
 	for i := 0; i < threadCount; i++ {
-		result := <-ch
-		PrintResult(result)
+		<-ch
+		perThread := <-histograms
+		readHistogram.Merge(perThread["READ"])
+		writeHistogram.Merge(perThread["WRITE"])
 	}
+	close(promDone)
 
-	DeleteAllObjects(bucket, ctx, objectCount)
+	deleteHistogram := NewHistogram()
+	DeleteAllObjects(bucket, ctx, objectCount, deleteHistogram)
 
 	fmt.Printf("# Deleting %v\n", bucketName)
 	if err := bucket.Delete(ctx); err != nil {
 		log.Fatal(err)
 	}
+
+	PrintHistogramSummary("CREATE", createHistogram)
+	PrintHistogramSummary("READ", readHistogram)
+	PrintHistogramSummary("WRITE", writeHistogram)
+	PrintHistogramSummary("DELETE", deleteHistogram)
+
+	for _, s := range sinks {
+		s.Flush()
+	}
 }
 
 func sample(letters []rune, n int) string {
@@ -152,9 +526,21 @@ func MakeRandomObjectName() string {
 	return sample(letters, 128)
 }
 
-func PrintResult(result TestResult) {
+func PrintResult(threadID int, result TestResult) {
 	for _, r := range result {
-		fmt.Printf("%s,%t,%d\n", r.op, r.success, r.elapsed.Nanoseconds()/1000000)
+		seq := atomic.AddInt64(&resultSeq, 1)
+		for _, s := range sinks {
+			// --no-raw only suppresses the raw CSV stream; the jsonl and
+			// prom sinks should keep seeing every record even when it is
+			// set, since that is precisely the flag a long endurance run
+			// feeding a Pushgateway would set.
+			if *suppressRaw {
+				if _, ok := s.(CSVSink); ok {
+					continue
+				}
+			}
+			s.Record(seq, threadID, r)
+		}
 	}
 }
 
@@ -174,22 +560,23 @@ func MakeRandomData(desiredSize int) string {
 	return result
 }
 
-func CreateOneObject(bucket *storage.BucketHandle, ctx context.Context, objectName string, data string) {
+func CreateOneObject(bucket *storage.BucketHandle, ctx context.Context, objectName string,
+	data string, histogram *Histogram) IterationResult {
 	start := time.Now()
 	w := bucket.Object(objectName).NewWriter(ctx)
 	if _, err := w.Write([]byte(data)); err != nil {
-		elapsed := time.Since(start)
-		fmt.Printf("CREATE,false,%d\n", elapsed.Nanoseconds()/1000000)
+		return IterationResult{op: "CREATE", success: false, elapsed: time.Since(start), transport: *transport}
 	}
 	if err := w.Close(); err != nil {
-		elapsed := time.Since(start)
-		fmt.Printf("CREATE,false,%d\n", elapsed.Nanoseconds()/1000000)
+		return IterationResult{op: "CREATE", success: false, elapsed: time.Since(start), transport: *transport}
 	}
 	elapsed := time.Since(start)
-	fmt.Printf("CREATE,true,%d\n", elapsed.Nanoseconds()/1000000)
+	histogram.Record(elapsed)
+	return IterationResult{op: "CREATE", success: true, elapsed: elapsed, transport: *transport}
 }
 
-func CreateAllObjects(bucket *storage.BucketHandle, ctx context.Context, objectCount int) []string {
+func CreateAllObjects(bucket *storage.BucketHandle, ctx context.Context, objectCount int,
+	histogram *Histogram) []string {
 	names := make([]string, 0, objectCount)
 	for i := 0; i < objectCount; i++ {
 		names = append(names, MakeRandomObjectName())
@@ -199,7 +586,8 @@ func CreateAllObjects(bucket *storage.BucketHandle, ctx context.Context, objectC
 	fmt.Printf("# Creating test objects [N/A]\n")
 	start := time.Now()
 	for _, name := range names {
-		CreateOneObject(bucket, ctx, name, data)
+		r := CreateOneObject(bucket, ctx, name, data, histogram)
+		PrintResult(0, TestResult{r})
 	}
 	elapsed := time.Since(start)
 	fmt.Printf("# Created in %dms\n", elapsed.Nanoseconds()/1000000)
@@ -210,53 +598,68 @@ func WriteOnce(bucket *storage.BucketHandle, ctx context.Context, objectName str
 	start := time.Now()
 	w := bucket.Object(objectName).NewWriter(ctx)
 	if _, err := w.Write([]byte(data)); err != nil {
-		return IterationResult{op: "WRITE", success: false, elapsed: time.Since(start)}
+		return IterationResult{op: "WRITE", success: false, elapsed: time.Since(start), transport: *transport}
 	}
 	if err := w.Close(); err != nil {
-		return IterationResult{op: "WRITE", success: false, elapsed: time.Since(start)}
+		return IterationResult{op: "WRITE", success: false, elapsed: time.Since(start), transport: *transport}
 	}
-	return IterationResult{op: "WRITE", success: true, elapsed: time.Since(start)}
+	return IterationResult{op: "WRITE", success: true, elapsed: time.Since(start), transport: *transport}
 }
 
 func ReadOnce(bucket *storage.BucketHandle, ctx context.Context, objectName string) IterationResult {
 	start := time.Now()
 	rd, err := bucket.Object(objectName).NewReader(ctx)
 	if err != nil {
-		return IterationResult{op: "READ", success: false, elapsed: time.Since(start)}
+		return IterationResult{op: "READ", success: false, elapsed: time.Since(start), transport: *transport}
 	}
 	_, err = ioutil.ReadAll(rd)
 	rd.Close()
 	if err != nil {
-		return IterationResult{op: "READ", success: false, elapsed: time.Since(start)}
+		return IterationResult{op: "READ", success: false, elapsed: time.Since(start), transport: *transport}
 	}
-	return IterationResult{op: "READ", success: true, elapsed: time.Since(start)}
+	return IterationResult{op: "READ", success: true, elapsed: time.Since(start), transport: *transport}
+}
+
+type threadResult struct {
+	threadID int
 }
 
 func RunTest(bucket *storage.BucketHandle, ctx context.Context, objectNames []string,
-	duration int,
-	ch chan TestResult) {
+	duration int, threadID int,
+	ch chan threadResult, histograms chan map[string]*Histogram) {
 	data := MakeRandomData(1024 * 1024)
-	result := make([]IterationResult, 0, 5*duration)
+	readHistogram := NewHistogram()
+	writeHistogram := NewHistogram()
 	deadline := time.Now().Add(time.Duration(duration) * time.Second)
 	for time.Now().Before(deadline) {
 		name := objectNames[rand.Intn(len(objectNames))]
+		var r IterationResult
 		if rand.Intn(100) < 50 {
-			result = append(result, WriteOnce(bucket, ctx, name, data))
+			r = WriteOnce(bucket, ctx, name, data)
+			writeHistogram.Record(r.elapsed)
 		} else {
-			result = append(result, ReadOnce(bucket, ctx, name))
+			r = ReadOnce(bucket, ctx, name)
+			readHistogram.Record(r.elapsed)
 		}
+		// Feed the sinks as each iteration completes rather than batching a
+		// whole thread's worth of results until it exits: with the default
+		// thread count equal to NumCPU, an endurance run would otherwise push
+		// nothing to the jsonl/prom sinks until the run was already over.
+		PrintResult(threadID, TestResult{r})
 	}
-	ch <- result
+	ch <- threadResult{threadID: threadID}
+	histograms <- map[string]*Histogram{"READ": readHistogram, "WRITE": writeHistogram}
 }
 
-func DeleteObject(bucket *storage.BucketHandle, ctx context.Context, objectName string) {
+func DeleteObject(bucket *storage.BucketHandle, ctx context.Context, objectName string, histogram *Histogram) IterationResult {
 	start := time.Now()
 	bucket.Object(objectName).Delete(ctx)
 	elapsed := time.Since(start)
-	fmt.Printf("DELETE,true,%d\n", elapsed.Nanoseconds()/1000000)
+	histogram.Record(elapsed)
+	return IterationResult{op: "DELETE", success: true, elapsed: elapsed, transport: *transport}
 }
 
-func DeleteAllObjects(bucket *storage.BucketHandle, ctx context.Context, objectCount int) {
+func DeleteAllObjects(bucket *storage.BucketHandle, ctx context.Context, objectCount int, histogram *Histogram) {
 	fmt.Printf("# Deleting test objects [N/A]\n")
 	start := time.Now()
 	names := make([]string, 0, objectCount)
@@ -272,7 +675,8 @@ func DeleteAllObjects(bucket *storage.BucketHandle, ctx context.Context, objectC
 		names = append(names, objAttrs.Name)
 	}
 	for _, name := range names {
-		DeleteObject(bucket, ctx, name)
+		r := DeleteObject(bucket, ctx, name, histogram)
+		PrintResult(0, TestResult{r})
 	}
 	elapsed := time.Since(start)
 	fmt.Printf("# Deleted in %dms\n", elapsed.Nanoseconds()/1000000)
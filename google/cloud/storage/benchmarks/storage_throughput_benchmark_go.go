@@ -15,20 +15,29 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"math/rand"
+	"net/http"
 	"os"
 	"path"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/storage"
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 )
 
 const (
@@ -37,58 +46,419 @@ const (
 	kChunkSize                        = 1024 * 1024
 	kDefaultObjectChunkCount          = 250
 	kThroughputReportIntervalInChunks = 4
-	kReadOp = 1
-	kWriteOp = 2
-	kCreateOp = 3
+	kReadOp                           = 1
+	kWriteOp                          = 2
+	kCreateOp                         = 3
+	kDeleteOp                         = 4
+	kComposeOp                        = 5
+	kComposePartOp                    = 6
+
+	// kMaxComposeParts is the GCS limit on the number of source objects a
+	// single compose call (ComposerFrom) can stitch together.
+	kMaxComposeParts = 32
+
+	// Histogram buckets span from 1ms to 60s, with ~15 buckets per decade.
+	// That is enough resolution to tell p50 from p99.9 apart without
+	// spending more than a few KiB per op-type, no matter how long the
+	// test runs.
+	kHistogramMinMs            = 1.0
+	kHistogramMaxMs            = 60000.0
+	kHistogramBucketsPerDecade = 15
+
+	// kPromPushInterval is how often the prom sink pushes a snapshot to the
+	// Pushgateway while RunTest is running, so an endurance run is actually
+	// visible on a dashboard while it is in progress, not just after the
+	// bucket has already been torn down.
+	kPromPushInterval = 15 * time.Second
 )
 
+var suppressRaw = flag.Bool("no-raw", false,
+	"suppress the raw per-iteration CSV output; the jsonl and prom sinks still receive every record")
+var uploadMode = flag.String("upload-mode", "sequential",
+	"upload strategy for object creation and writes: sequential, resumable, or compose")
+var transport = flag.String("transport", envOrDefault("STORAGE_TRANSPORT", "http"),
+	"storage transport to use: http or grpc (env: STORAGE_TRANSPORT)")
+var endpoint = flag.String("endpoint", os.Getenv("STORAGE_ENDPOINT"),
+	"optional API endpoint override, e.g. for an emulator or a private endpoint (env: STORAGE_ENDPOINT)")
+var pushgatewayURL = flag.String("pushgateway", "",
+	"Prometheus Pushgateway URL to push per-op counters and latency histogram buckets to")
+
+func envOrDefault(name string, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// stringSliceFlag implements flag.Value to collect a repeatable flag into a
+// slice, e.g. --output=csv --output=jsonl.
+type stringSliceFlag []string
+
+func (s *stringSliceFlag) String() string { return strings.Join(*s, ",") }
+
+func (s *stringSliceFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+var outputModes stringSliceFlag
+
+func init() {
+	flag.Var(&outputModes, "output", "result sink(s) to enable: csv, jsonl, or prom (repeatable, default csv)")
+}
+
+// gBucketName and gLocation are set once in main and read by sinks that
+// annotate every record with which run produced it.
+var gBucketName string
+var gLocation string
+
+// resultSeq is a monotonically increasing sequence number shared by every
+// sink, so records from different threads can be ordered back together.
+var resultSeq int64
+
+// composeAttemptSeq is a monotonically increasing sequence number minted per
+// UploadByCompose call, so two threads composing the same object name at the
+// same time still write to distinct "<obj>.part.<attempt>.<i>" part names.
+var composeAttemptSeq int64
+
 type IterationResult struct {
-	op      int
-	bytes   int
-	elapsed time.Duration
+	op        int
+	bytes     int
+	elapsed   time.Duration
+	transport string
 }
 
 type TestResult []IterationResult
 
+// Histogram is a small, fixed-memory latency histogram with logarithmically
+// spaced buckets. It is meant to be owned by a single goroutine while
+// samples are being recorded (so Record needs no locking) and combined with
+// Merge once the goroutine is done.
+type Histogram struct {
+	bounds []float64 // upper bound, in milliseconds, of each bucket but the last
+	counts []int64
+	count  int64
+	sum    float64
+	min    float64
+	max    float64
+}
+
+func NewHistogram() *Histogram {
+	var bounds []float64
+	ratio := math.Pow(10, 1.0/kHistogramBucketsPerDecade)
+	for b := kHistogramMinMs; b < kHistogramMaxMs; b *= ratio {
+		bounds = append(bounds, b)
+	}
+	return &Histogram{bounds: bounds, counts: make([]int64, len(bounds)+1), min: math.MaxFloat64}
+}
+
+func (h *Histogram) Record(elapsed time.Duration) {
+	ms := float64(elapsed) / float64(time.Millisecond)
+	h.counts[sort.SearchFloat64s(h.bounds, ms)]++
+	h.count++
+	h.sum += ms
+	if ms < h.min {
+		h.min = ms
+	}
+	if ms > h.max {
+		h.max = ms
+	}
+}
+
+func (h *Histogram) Merge(other *Histogram) {
+	for i := range h.counts {
+		h.counts[i] += other.counts[i]
+	}
+	h.count += other.count
+	h.sum += other.sum
+	if other.min < h.min {
+		h.min = other.min
+	}
+	if other.max > h.max {
+		h.max = other.max
+	}
+}
+
+// Percentile returns the upper bound, in milliseconds, of the bucket
+// containing the p-th percentile (0 < p <= 100).
+func (h *Histogram) Percentile(p float64) float64 {
+	if h.count == 0 {
+		return 0
+	}
+	target := int64(math.Ceil(p / 100.0 * float64(h.count)))
+	var running int64
+	for i, c := range h.counts {
+		running += c
+		if running >= target {
+			if i < len(h.bounds) {
+				return h.bounds[i]
+			}
+			return h.max
+		}
+	}
+	return h.max
+}
+
+func (h *Histogram) Mean() float64 {
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / float64(h.count)
+}
+
+func opName(op int) string {
+	switch op {
+	case kReadOp:
+		return "READ"
+	case kWriteOp:
+		return "WRITE"
+	case kCreateOp:
+		return "CREATE"
+	case kDeleteOp:
+		return "DELETE"
+	case kComposeOp:
+		return "COMPOSE"
+	case kComposePartOp:
+		return "COMPOSE_PART"
+	}
+	return "UNKNOWN"
+}
+
+func PrintHistogramSummary(op int, h *Histogram) {
+	if h.count == 0 {
+		return
+	}
+	fmt.Printf("# %-6s latency(ms): count=%-8d min=%-10.1f mean=%-10.1f p50=%-10.1f"+
+		" p90=%-10.1f p99=%-10.1f p99.9=%-10.1f max=%-10.1f\n",
+		opName(op), h.count, h.min, h.Mean(), h.Percentile(50), h.Percentile(90),
+		h.Percentile(99), h.Percentile(99.9), h.max)
+}
+
+// ResultSink receives every IterationResult as the benchmark runs and does
+// something durable with it. Record is called once per iteration; Flush is
+// called at shutdown, after the bucket under test has been torn down, so
+// sinks that batch or push to a remote system get a chance to drain. A
+// PromSink's Flush is also called every kPromPushInterval while RunTest runs,
+// see startPeriodicPromPush.
+type ResultSink interface {
+	Record(seq int64, threadID int, r IterationResult)
+	Flush()
+}
+
+// CSVSink prints the benchmark's plain "op,bytes,elapsed_ms,transport" CSV
+// stream, kept as the default sink for scripts that already parse it.
+type CSVSink struct{}
+
+func (CSVSink) Record(seq int64, threadID int, r IterationResult) {
+	fmt.Printf("%s,%d,%d,%s\n", opName(r.op), r.bytes, r.elapsed.Nanoseconds()/1000000, r.transport)
+}
+
+func (CSVSink) Flush() {}
+
+// jsonlRecord is the schema written, one per line, by JSONLSink.
+type jsonlRecord struct {
+	Seq       int64  `json:"seq"`
+	Bucket    string `json:"bucket"`
+	Location  string `json:"location"`
+	ThreadID  int    `json:"thread_id"`
+	Transport string `json:"transport"`
+	Op        string `json:"op"`
+	Bytes     int    `json:"bytes"`
+	ElapsedNs int64  `json:"elapsed_ns"`
+}
+
+// JSONLSink writes one self-describing JSON object per iteration, so results
+// can be loaded into a dataframe or a log pipeline without a CSV schema
+// living out-of-band.
+type JSONLSink struct{}
+
+func (JSONLSink) Record(seq int64, threadID int, r IterationResult) {
+	b, err := json.Marshal(jsonlRecord{
+		Seq:       seq,
+		Bucket:    gBucketName,
+		Location:  gLocation,
+		ThreadID:  threadID,
+		Transport: r.transport,
+		Op:        opName(r.op),
+		Bytes:     r.bytes,
+		ElapsedNs: r.elapsed.Nanoseconds(),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "# Error marshaling jsonl record: %v\n", err)
+		return
+	}
+	fmt.Println(string(b))
+}
+
+func (JSONLSink) Flush() {}
+
+// PromSink accumulates an op-counter and a latency Histogram per op-type and
+// pushes both, in Prometheus text exposition format, to a Pushgateway URL on
+// Flush. This is meant for long endurance runs, where graphing live matters
+// more than a post-hoc CSV/JSONL file.
+type PromSink struct {
+	url string
+
+	mu     sync.Mutex
+	counts map[string]int64
+	hist   map[string]*Histogram
+}
+
+func NewPromSink(url string) *PromSink {
+	return &PromSink{url: url, counts: make(map[string]int64), hist: make(map[string]*Histogram)}
+}
+
+func (p *PromSink) Record(seq int64, threadID int, r IterationResult) {
+	op := opName(r.op)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.counts[op]++
+	h, ok := p.hist[op]
+	if !ok {
+		h = NewHistogram()
+		p.hist[op] = h
+	}
+	h.Record(r.elapsed)
+}
+
+func (p *PromSink) Flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# TYPE gcs_benchmark_op_total counter\n")
+	for op, c := range p.counts {
+		fmt.Fprintf(&buf, "gcs_benchmark_op_total{op=%q,transport=%q} %d\n", op, *transport, c)
+	}
+	fmt.Fprintf(&buf, "# TYPE gcs_benchmark_latency_ms_bucket histogram\n")
+	for op, h := range p.hist {
+		var cumulative int64
+		for i, bound := range h.bounds {
+			cumulative += h.counts[i]
+			fmt.Fprintf(&buf, "gcs_benchmark_latency_ms_bucket{op=%q,transport=%q,le=%q} %d\n",
+				op, *transport, strconv.FormatFloat(bound, 'f', -1, 64), cumulative)
+		}
+		cumulative += h.counts[len(h.counts)-1]
+		fmt.Fprintf(&buf, "gcs_benchmark_latency_ms_bucket{op=%q,transport=%q,le=\"+Inf\"} %d\n", op, *transport, cumulative)
+		fmt.Fprintf(&buf, "gcs_benchmark_latency_ms_sum{op=%q,transport=%q} %f\n", op, *transport, h.sum)
+		fmt.Fprintf(&buf, "gcs_benchmark_latency_ms_count{op=%q,transport=%q} %d\n", op, *transport, h.count)
+	}
+
+	jobURL := fmt.Sprintf("%s/metrics/job/gcs_go_throughput_benchmark/instance/%s",
+		strings.TrimRight(p.url, "/"), gBucketName)
+	resp, err := http.Post(jobURL, "text/plain; version=0.0.4", &buf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "# Error pushing to pushgateway: %v\n", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// startPeriodicPromPush pushes every PromSink's current snapshot to its
+// Pushgateway on kPromPushInterval until done is closed, so the gateway sees
+// a live series while RunTest runs instead of only a single post-hoc push.
+func startPeriodicPromPush(done <-chan struct{}) {
+	var promSinks []*PromSink
+	for _, s := range sinks {
+		if ps, ok := s.(*PromSink); ok {
+			promSinks = append(promSinks, ps)
+		}
+	}
+	if len(promSinks) == 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(kPromPushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for _, ps := range promSinks {
+					ps.Flush()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// sinks holds the active ResultSinks, built from --output and --pushgateway
+// once flags have been parsed.
+var sinks []ResultSink
+
+func buildSinks() []ResultSink {
+	modes := []string(outputModes)
+	if len(modes) == 0 {
+		modes = []string{"csv"}
+	}
+	var result []ResultSink
+	sawProm := false
+	for _, m := range modes {
+		switch m {
+		case "csv":
+			result = append(result, CSVSink{})
+		case "jsonl":
+			result = append(result, JSONLSink{})
+		case "prom":
+			if *pushgatewayURL == "" {
+				log.Fatal("--output=prom requires --pushgateway")
+			}
+			result = append(result, NewPromSink(*pushgatewayURL))
+			sawProm = true
+		default:
+			log.Fatalf("unknown --output value %q, want csv, jsonl, or prom", m)
+		}
+	}
+	if *pushgatewayURL != "" && !sawProm {
+		result = append(result, NewPromSink(*pushgatewayURL))
+	}
+	return result
+}
+
 func main() {
+	flag.Parse()
+	sinks = buildSinks()
+
 	duration := kDefaultDurationSeconds
 	objectCount := kDefaultObjectCount
 	objectChunkCount := kDefaultObjectChunkCount
 	threadCount := 1
 
-	if len(os.Args) < 2 {
-		fmt.Fprintf(os.Stderr, "Usage: %s <location>"+
+	if flag.NArg() < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <location>"+
 			" [duration-in-seconds (%d)] [object-count (%d)] [object-size-in-chunks (%d)] [thread-count (%d)]\n",
 			path.Base(os.Args[0]), duration, objectCount, objectChunkCount, threadCount)
+		flag.PrintDefaults()
 		os.Exit(1)
 	}
-	location := os.Args[1]
+	location := flag.Arg(0)
 
-	if len(os.Args) > 2 {
-		v, err := strconv.Atoi(os.Args[2])
+	if flag.NArg() > 1 {
+		v, err := strconv.Atoi(flag.Arg(1))
 		if err != nil {
-			log.Fatal("%v while parsing duration argument (%s)", err, os.Args[2])
+			log.Fatal("%v while parsing duration argument (%s)", err, flag.Arg(1))
 		}
 		duration = v
 	}
-	if len(os.Args) > 3 {
-		v, err := strconv.Atoi(os.Args[3])
+	if flag.NArg() > 2 {
+		v, err := strconv.Atoi(flag.Arg(2))
 		if err != nil {
-			log.Fatal("%v while parsing object-count argument (%s)", err, os.Args[3])
+			log.Fatal("%v while parsing object-count argument (%s)", err, flag.Arg(2))
 		}
 		objectCount = v
 	}
-	if len(os.Args) > 4 {
-		v, err := strconv.Atoi(os.Args[4])
+	if flag.NArg() > 3 {
+		v, err := strconv.Atoi(flag.Arg(3))
 		if err != nil {
-			log.Fatal("%v while parsing object-chunk-count argument (%s)", err, os.Args[4])
+			log.Fatal("%v while parsing object-chunk-count argument (%s)", err, flag.Arg(3))
 		}
 		objectChunkCount = v
 	}
-	if len(os.Args) > 5 {
-		v, err := strconv.Atoi(os.Args[5])
+	if flag.NArg() > 4 {
+		v, err := strconv.Atoi(flag.Arg(4))
 		if err != nil {
-			log.Fatal("%v while parsing thread-count argument (%s)", err, os.Args[4])
+			log.Fatal("%v while parsing thread-count argument (%s)", err, flag.Arg(4))
 		}
 		threadCount = v
 	}
@@ -101,7 +471,26 @@ func main() {
 		os.Exit(1)
 	}
 
-	client, err := storage.NewClient(ctx)
+	switch *uploadMode {
+	case "sequential", "resumable", "compose":
+	default:
+		log.Fatalf("unknown --upload-mode value %q, want sequential, resumable, or compose", *uploadMode)
+	}
+
+	var clientOpts []option.ClientOption
+	if *endpoint != "" {
+		clientOpts = append(clientOpts, option.WithEndpoint(*endpoint))
+	}
+	var client *storage.Client
+	var err error
+	switch *transport {
+	case "grpc":
+		client, err = storage.NewGRPCClient(ctx, clientOpts...)
+	case "http":
+		client, err = storage.NewClient(ctx, clientOpts...)
+	default:
+		log.Fatalf("unknown --transport value %q, want http or grpc", *transport)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -111,6 +500,8 @@ func main() {
 	rand.Seed(time.Now().UnixNano())
 
 	bucketName := MakeRandomBucketName()
+	gBucketName = bucketName
+	gLocation = location
 	bucket := client.Bucket(bucketName)
 	if err := bucket.Create(ctx, projectID, &storage.BucketAttrs{
 		StorageClass:               "REGIONAL",
@@ -126,16 +517,29 @@ func main() {
 	fmt.Printf("# Object Count: %d\n", objectCount)
 	fmt.Printf("# Object Chunk Count: %d\n", objectChunkCount)
 	fmt.Printf("# Thread Count: %d\n", threadCount)
+	fmt.Printf("# Transport: %s\n", *transport)
 	fmt.Printf("# Build info: %s\n", runtime.Version())
 
-	objectNames := CreateAllObjects(bucket, ctx, objectCount, objectChunkCount, threadCount)
-	RunTest(bucket, ctx, duration, objectNames, objectChunkCount, threadCount)
-	DeleteAllObjects(bucket, ctx, objectCount)
+	createHistogram := NewHistogram()
+	objectNames := CreateAllObjects(bucket, ctx, objectCount, objectChunkCount, threadCount, createHistogram)
+	readHistogram, writeHistogram := RunTest(bucket, ctx, duration, objectNames, objectChunkCount, threadCount)
+
+	deleteHistogram := NewHistogram()
+	DeleteAllObjects(bucket, ctx, objectCount, deleteHistogram)
 
 	fmt.Printf("# Deleting %v\n", bucketName)
 	if err := bucket.Delete(ctx); err != nil {
 		log.Fatal(err)
 	}
+
+	PrintHistogramSummary(kCreateOp, createHistogram)
+	PrintHistogramSummary(kReadOp, readHistogram)
+	PrintHistogramSummary(kWriteOp, writeHistogram)
+	PrintHistogramSummary(kDeleteOp, deleteHistogram)
+
+	for _, s := range sinks {
+		s.Flush()
+	}
 }
 
 func sample(letters []rune, n int) string {
@@ -160,56 +564,42 @@ func MakeRandomObjectName() string {
 	return sample(letters, 128)
 }
 
-func PrintResult(result TestResult) {
+func PrintResult(threadID int, result TestResult) {
 	for _, r := range result {
-	        op := "UNKNOWN"
-		if r.op == kReadOp {
-		    op = "READ"
-		}
-		if r.op == kWriteOp {
-		    op = "WRITE"
-		}
-		if r.op == kCreateOp {
-		    op = "CREATE"
+		seq := atomic.AddInt64(&resultSeq, 1)
+		for _, s := range sinks {
+			// --no-raw only suppresses the raw CSV stream; the jsonl and
+			// prom sinks should keep seeing every record even when it is
+			// set, since that is precisely the flag a long endurance run
+			// feeding a Pushgateway would set.
+			if *suppressRaw {
+				if _, ok := s.(CSVSink); ok {
+					continue
+				}
+			}
+			s.Record(seq, threadID, r)
 		}
-		fmt.Printf("%s,%d,%d\n", op, r.bytes, r.elapsed.Nanoseconds()/1000000)
-	}
-}
-
-func MakeRandomData(desiredSize int) string {
-	chars := []rune("abcdefghijklmnopqrstuvwxyz" + "ABCDEFGHIJKLMNOPQRSTUVWXYZ" +
-		"0123456789" + " - _ : /")
-	const (
-		kLineSize = 128
-	)
-	result := ""
-	for len(result)+kLineSize < desiredSize {
-		result = result + sample(chars, kLineSize-1) + "\n"
-	}
-	if len(result) < desiredSize {
-		result = result + sample(chars, desiredSize-len(result))
 	}
-	return result
 }
 
 func CreateOneObject(bucket *storage.BucketHandle, ctx context.Context,
-	objectName string, data string, objectChunkCount int) []IterationResult {
-	return WriteCommon(bucket, ctx, objectName, data, objectChunkCount, kCreateOp)
+	objectName string, objectChunkCount int, threadCount int) []IterationResult {
+	return WriteCommon(bucket, ctx, objectName, objectChunkCount, threadCount, kCreateOp)
 }
 
 func CreateAllObjects(bucket *storage.BucketHandle, ctx context.Context,
-	objectCount int, objectChunkCount int, threadCount int) []string {
+	objectCount int, objectChunkCount int, threadCount int, histogram *Histogram) []string {
 	names := make([]string, 0, objectCount)
 	for i := 0; i < objectCount; i++ {
 		names = append(names, MakeRandomObjectName())
 	}
 
-	data := MakeRandomData(kChunkSize)
 	fmt.Printf("# Creating test objects [N/A]\n")
 	start := time.Now()
 	for _, name := range names {
-		r := CreateOneObject(bucket, ctx, name, data, objectChunkCount)
-		PrintResult(r)
+		r := CreateOneObject(bucket, ctx, name, objectChunkCount, threadCount)
+		histogram.Record(r[len(r)-1].elapsed)
+		PrintResult(0, r)
 	}
 	elapsed := time.Since(start)
 	fmt.Printf("# Created in %dms\n", elapsed.Nanoseconds()/1000000)
@@ -217,33 +607,232 @@ func CreateAllObjects(bucket *storage.BucketHandle, ctx context.Context,
 }
 
 func WriteOnce(bucket *storage.BucketHandle, ctx context.Context,
-	objectName string, data string, objectChunkCount int) []IterationResult {
-	return WriteCommon(bucket, ctx, objectName, data, objectChunkCount, kWriteOp)
+	objectName string, objectChunkCount int, threadCount int) []IterationResult {
+	return WriteCommon(bucket, ctx, objectName, objectChunkCount, threadCount, kWriteOp)
 }
 
+// WriteCommon creates or overwrites objectName with objectChunkCount chunks
+// of pseudo-random data. The "sequential" and "resumable" modes both stream
+// the object through a single resumable Writer, see WriteRandomStream (the
+// GCS client already negotiates a resumable session once the object crosses
+// its internal chunk-size threshold, so there is nothing extra to do to get
+// resumable semantics). The "compose" mode instead uploads the object in
+// parallel parts and stitches them together with ComposerFrom, see
+// UploadByCompose. Both paths generate their pseudo-random payload on the
+// fly rather than rewriting a shared buffer, so throughput numbers reflect
+// genuine upload bandwidth rather than buffer-copy speed.
 func WriteCommon(bucket *storage.BucketHandle, ctx context.Context,
-	objectName string, data string, objectChunkCount int, opName int) []IterationResult {
+	objectName string, objectChunkCount int, threadCount int, op int) []IterationResult {
+	if *uploadMode == "compose" {
+		return UploadByCompose(bucket, ctx, objectName, objectChunkCount, threadCount, op)
+	}
+	return WriteRandomStream(bucket, ctx, objectName, int64(objectChunkCount)*kChunkSize, op)
+}
+
+// countingWriter wraps an io.Writer and tracks the number of bytes written
+// so far, safe to read from another goroutine via atomic.LoadInt64.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+// WriteRandomStream uploads totalSize bytes of pseudo-random data, generated
+// on the fly and seeded per-object so it is not compressible, through a
+// single io.Copy. A single large object used to be built by rewriting the
+// same 1MB buffer objectChunkCount times, which measured buffer-copy speed
+// more than actual upload throughput; streaming through an io.Pipe gives an
+// accurate single-stream number instead and avoids the per-goroutine buffer
+// allocation altogether.
+func WriteRandomStream(bucket *storage.BucketHandle, ctx context.Context,
+	objectName string, totalSize int64, op int) []IterationResult {
 	start := time.Now()
-	result := make([]IterationResult, 0, objectChunkCount)
+	reportBoundary := int64(kThroughputReportIntervalInChunks * kChunkSize)
+
+	pr, pw := io.Pipe()
+	src := rand.New(rand.NewSource(start.UnixNano() + int64(len(objectName))))
+	cw := &countingWriter{w: pw}
+	go func() {
+		if _, err := io.CopyN(cw, src, totalSize); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.Close()
+	}()
+
+	reportCh := make(chan IterationResult, totalSize/reportBoundary+1)
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		reported := int64(0)
+		for {
+			select {
+			case <-ticker.C:
+				written := atomic.LoadInt64(&cw.n)
+				for written-reported >= reportBoundary {
+					reported += reportBoundary
+					reportCh <- IterationResult{op: op, bytes: int(reported), elapsed: time.Since(start), transport: *transport}
+				}
+			case <-done:
+				close(reportCh)
+				return
+			}
+		}
+	}()
 
 	w := bucket.Object(objectName).NewWriter(ctx)
-	for i := 0; i < objectChunkCount; i++ {
-	    r := strings.NewReader(data)
-	    n, err := io.Copy(w, r)
-	    if err != nil {
-			result = append(result, IterationResult{op: opName, bytes: -1, elapsed: time.Since(start)})
+	n, err := io.Copy(w, pr)
+	close(done)
+	if err != nil {
+		// io.Copy stopped before draining pr, so the producer goroutine
+		// above is still blocked on pw.Write; close the read side with the
+		// same error to unblock it and let it exit instead of leaking.
+		pr.CloseWithError(err)
+		return []IterationResult{{op: op, bytes: -1, elapsed: time.Since(start), transport: *transport}}
+	}
+	if err := w.Close(); err != nil {
+		pr.CloseWithError(err)
+		return []IterationResult{{op: op, bytes: -1, elapsed: time.Since(start), transport: *transport}}
+	}
+	if n != totalSize {
+		fmt.Printf("# Short write %d / %d\n", n, totalSize)
+	}
+
+	result := make([]IterationResult, 0, cap(reportCh)+1)
+	for r := range reportCh {
+		result = append(result, r)
+	}
+	result = append(result, IterationResult{op: op, bytes: int(totalSize), elapsed: time.Since(start), transport: *transport})
+	return result
+}
+
+// UploadByCompose splits objectName into up to kMaxComposeParts parts (named
+// "<objectName>.part.<attempt>.<i>", attempt being unique per call so two
+// threads composing the same object name never collide on a part name),
+// uploads them concurrently, then stitches them together into the final
+// object with a single ComposerFrom call, in part order, and deletes the
+// parts. Each part streams its own pseudo-random payload through an
+// io.Pipe, seeded per-part so it is not compressible and so every part of
+// every object is distinct data rather than one shared buffer rewritten
+// over and over, see WriteRandomStream. It returns one IterationResult per
+// part upload (op kComposePartOp, distinct from op so a single-threaded
+// compose does not double-count the same bytes as both a part and the
+// final result), one for the compose call itself (op kComposeOp), and a
+// final IterationResult covering the whole operation so callers can treat
+// the last entry as the total elapsed time, just as they do for the
+// sequential path. If any part failed to upload, the compose is skipped
+// entirely rather than handed a truncated source; if the compose call
+// itself fails, the same applies. Either way the compose and final
+// IterationResults carry bytes: -1 and the parts are left in place for
+// inspection rather than deleted, since the object they would have
+// composed into was never produced.
+func UploadByCompose(bucket *storage.BucketHandle, ctx context.Context,
+	objectName string, objectChunkCount int, threadCount int, op int) []IterationResult {
+	start := time.Now()
+
+	parts := threadCount
+	if parts < 1 {
+		parts = 1
+	}
+	if objectChunkCount > 0 && parts > objectChunkCount {
+		parts = objectChunkCount
+	}
+	if parts > kMaxComposeParts {
+		parts = kMaxComposeParts
+	}
+	base := objectChunkCount / parts
+	extra := objectChunkCount % parts
+	attempt := atomic.AddInt64(&composeAttemptSeq, 1)
+
+	type partUpload struct {
+		index  int
+		name   string
+		result IterationResult
+	}
+	ch := make(chan partUpload, parts)
+	for i := 0; i < parts; i++ {
+		chunkCount := base
+		if i < extra {
+			chunkCount++
 		}
-	    if n != int64(len(data)) {
-	       fmt.Printf("# Short write %d / %d\n", n, len(data))
-	    }
-		if i != 0 && i%kThroughputReportIntervalInChunks == 0 {
-			result = append(result, IterationResult{op: opName, bytes: i * len(data), elapsed: time.Since(start)})
+		go func(i int, chunkCount int) {
+			partName := fmt.Sprintf("%s.part.%d.%d", objectName, attempt, i)
+			partStart := time.Now()
+			partSize := int64(chunkCount) * kChunkSize
+
+			pr, pw := io.Pipe()
+			src := rand.New(rand.NewSource(partStart.UnixNano() + int64(len(partName)) + int64(i)))
+			go func() {
+				if _, err := io.CopyN(pw, src, partSize); err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+				pw.Close()
+			}()
+
+			w := bucket.Object(partName).NewWriter(ctx)
+			n, err := io.Copy(w, pr)
+			if err != nil {
+				pr.CloseWithError(err)
+				ch <- partUpload{i, partName, IterationResult{op: kComposePartOp, bytes: -1, elapsed: time.Since(partStart), transport: *transport}}
+				return
+			}
+			if err := w.Close(); err != nil {
+				ch <- partUpload{i, partName, IterationResult{op: kComposePartOp, bytes: -1, elapsed: time.Since(partStart), transport: *transport}}
+				return
+			}
+			ch <- partUpload{i, partName, IterationResult{op: kComposePartOp, bytes: int(n), elapsed: time.Since(partStart), transport: *transport}}
+		}(i, chunkCount)
+	}
+
+	result := make([]IterationResult, 0, parts+2)
+	// partNames is indexed by part number rather than completion order, so
+	// ComposerFrom stitches the parts back together in the right sequence.
+	partNames := make([]string, parts)
+	anyPartFailed := false
+	for i := 0; i < parts; i++ {
+		u := <-ch
+		result = append(result, u.result)
+		partNames[u.index] = u.name
+		if u.result.bytes < 0 {
+			anyPartFailed = true
 		}
 	}
-	if err := w.Close(); err != nil {
-	   fmt.Printf("# Error %v\n", err);
+
+	composeStart := time.Now()
+	if anyPartFailed {
+		fmt.Printf("# Skipping compose of %s: one or more parts failed to upload\n", objectName)
+		result = append(result, IterationResult{op: kComposeOp, bytes: -1, elapsed: time.Since(composeStart), transport: *transport})
+		fmt.Printf("# Leaving parts of %s in place for inspection after a part upload failure\n", objectName)
+		result = append(result, IterationResult{op: op, bytes: -1, elapsed: time.Since(start), transport: *transport})
+		return result
+	}
+
+	srcs := make([]*storage.ObjectHandle, 0, len(partNames))
+	for _, name := range partNames {
+		srcs = append(srcs, bucket.Object(name))
+	}
+	_, composeErr := bucket.Object(objectName).ComposerFrom(srcs...).Run(ctx)
+	if composeErr != nil {
+		fmt.Printf("# Error composing %s: %v\n", objectName, composeErr)
+		result = append(result, IterationResult{op: kComposeOp, bytes: -1, elapsed: time.Since(composeStart), transport: *transport})
+		fmt.Printf("# Leaving parts of %s in place for inspection after the compose failure\n", objectName)
+		result = append(result, IterationResult{op: op, bytes: -1, elapsed: time.Since(start), transport: *transport})
+		return result
+	}
+	result = append(result, IterationResult{op: kComposeOp, bytes: int(int64(objectChunkCount) * kChunkSize), elapsed: time.Since(composeStart), transport: *transport})
+
+	for _, name := range partNames {
+		bucket.Object(name).Delete(ctx)
 	}
-	result = append(result, IterationResult{op: opName, bytes: objectChunkCount * len(data), elapsed: time.Since(start)})
+
+	result = append(result, IterationResult{op: op, bytes: int(int64(objectChunkCount) * kChunkSize), elapsed: time.Since(start), transport: *transport})
 	return result
 }
 
@@ -253,7 +842,7 @@ func ReadOnce(bucket *storage.BucketHandle, ctx context.Context, objectName stri
 
 	rd, err := bucket.Object(objectName).NewReader(ctx)
 	if err != nil {
-		result = append(result, IterationResult{op: kReadOp, bytes: 0, elapsed: time.Since(start)})
+		result = append(result, IterationResult{op: kReadOp, bytes: 0, elapsed: time.Since(start), transport: *transport})
 		return result
 	}
 	buf := make([]byte, 4096)
@@ -264,55 +853,82 @@ func ReadOnce(bucket *storage.BucketHandle, ctx context.Context, objectName stri
 	for {
 		n, err := io.ReadFull(rd, buf)
 		if err == io.EOF {
-		   break
+			break
 		}
 		if err != nil {
-			result = append(result, IterationResult{op: kReadOp, bytes: -1, elapsed: time.Since(start)})
+			result = append(result, IterationResult{op: kReadOp, bytes: -1, elapsed: time.Since(start), transport: *transport})
 			continue
 		}
 		totalSize += n
 		if totalSize != 0 && totalSize%report == 0 {
-			result = append(result, IterationResult{op: kReadOp, bytes: totalSize, elapsed: time.Since(start)})
+			result = append(result, IterationResult{op: kReadOp, bytes: totalSize, elapsed: time.Since(start), transport: *transport})
 		}
 	}
 	rd.Close()
-	result = append(result, IterationResult{op: kReadOp, bytes: totalSize, elapsed: time.Since(start)})
+	result = append(result, IterationResult{op: kReadOp, bytes: totalSize, elapsed: time.Since(start), transport: *transport})
 	return result
 }
 
+type threadResult struct {
+	threadID int
+}
+
 func RunTestThread(bucket *storage.BucketHandle, ctx context.Context,
-	duration int, objectNames []string, objectChunkCount int, ch chan TestResult) {
-	data := MakeRandomData(kChunkSize)
-	result := make([]IterationResult, 0, duration*objectChunkCount/10)
+	duration int, objectNames []string, objectChunkCount int, threadCount int, threadID int,
+	ch chan threadResult, histograms chan map[int]*Histogram) {
+	readHistogram := NewHistogram()
+	writeHistogram := NewHistogram()
 	deadline := time.Now().Add(time.Duration(duration) * time.Second)
 	for time.Now().Before(deadline) {
 		name := objectNames[rand.Intn(len(objectNames))]
+		var r []IterationResult
 		if rand.Intn(100) < 50 {
-			result = append(result, WriteOnce(bucket, ctx, name, data, objectChunkCount)...)
+			r = WriteOnce(bucket, ctx, name, objectChunkCount, threadCount)
+			writeHistogram.Record(r[len(r)-1].elapsed)
 		} else {
-			result = append(result, ReadOnce(bucket, ctx, name)...)
+			r = ReadOnce(bucket, ctx, name)
+			readHistogram.Record(r[len(r)-1].elapsed)
 		}
+		// Feed the sinks as each iteration completes rather than batching a
+		// whole thread's worth of results until it exits: with the default
+		// thread count of 1, an endurance run would otherwise push nothing
+		// to the jsonl/prom sinks until the run was already over.
+		PrintResult(threadID, r)
 	}
-	ch <- result
+	ch <- threadResult{threadID: threadID}
+	histograms <- map[int]*Histogram{kReadOp: readHistogram, kWriteOp: writeHistogram}
 }
 
 func RunTest(bucket *storage.BucketHandle, ctx context.Context,
-	duration int, objectNames []string, objectChunkCount int, threadCount int) {
-	ch := make(chan TestResult, threadCount)
+	duration int, objectNames []string, objectChunkCount int, threadCount int) (*Histogram, *Histogram) {
+	ch := make(chan threadResult, threadCount)
+	histograms := make(chan map[int]*Histogram, threadCount)
+	promDone := make(chan struct{})
+	startPeriodicPromPush(promDone)
 	for i := 0; i < threadCount; i++ {
-		go RunTestThread(bucket, ctx, duration, objectNames, objectChunkCount, ch)
+		go RunTestThread(bucket, ctx, duration, objectNames, objectChunkCount, threadCount, i+1, ch, histograms)
 	}
+	readHistogram := NewHistogram()
+	writeHistogram := NewHistogram()
 	for i := 0; i < threadCount; i++ {
-		result := <-ch
-		PrintResult(result)
+		<-ch
+		perThread := <-histograms
+		readHistogram.Merge(perThread[kReadOp])
+		writeHistogram.Merge(perThread[kWriteOp])
 	}
+	close(promDone)
+	return readHistogram, writeHistogram
 }
 
-func DeleteObject(bucket *storage.BucketHandle, ctx context.Context, objectName string) {
+func DeleteObject(bucket *storage.BucketHandle, ctx context.Context, objectName string, histogram *Histogram) IterationResult {
+	start := time.Now()
 	bucket.Object(objectName).Delete(ctx)
+	elapsed := time.Since(start)
+	histogram.Record(elapsed)
+	return IterationResult{op: kDeleteOp, bytes: 0, elapsed: elapsed, transport: *transport}
 }
 
-func DeleteAllObjects(bucket *storage.BucketHandle, ctx context.Context, objectCount int) {
+func DeleteAllObjects(bucket *storage.BucketHandle, ctx context.Context, objectCount int, histogram *Histogram) {
 	fmt.Printf("# Deleting test objects [N/A]\n")
 	start := time.Now()
 	names := make([]string, 0, objectCount)
@@ -328,7 +944,8 @@ func DeleteAllObjects(bucket *storage.BucketHandle, ctx context.Context, objectC
 		names = append(names, objAttrs.Name)
 	}
 	for _, name := range names {
-		DeleteObject(bucket, ctx, name)
+		r := DeleteObject(bucket, ctx, name, histogram)
+		PrintResult(0, TestResult{r})
 	}
 	elapsed := time.Since(start)
 	fmt.Printf("# Deleted in %dms\n", elapsed.Nanoseconds()/1000000)